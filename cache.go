@@ -1,30 +1,53 @@
 package servicecache
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/hashicorp/consul/api"
-	"log"
-	"math/rand"
 	"sync"
 	"time"
 )
 
-type ServiceRetriever func(consulAddress string) (map[string]*api.AgentService, error)
+type ServiceRetriever func(ctx context.Context, consulAddress string) (map[string]*api.AgentService, error)
+
+var (
+	errorServiceNotAvailable  = errors.New("Requested Service is not avaiable")
+	errorServiceNotRegistered = errors.New("Requested unregistered service")
+)
 
 type ConsulCache struct {
 	*sync.RWMutex
-	serviceMap       map[string][]*api.AgentService
-	alreadyRunning   bool
-	ticker           *time.Ticker
-	consulAddress    string
-	abortChan        chan bool
-	ErrorChan        chan error
-	SuccessChan      chan bool
-	serviceRetriever ServiceRetriever
-	refreshIntervall time.Duration
+	serviceMap         map[string][]*api.AgentService
+	serviceVersions    map[string]uint64
+	lastSuccess        map[string]time.Time
+	subMu              sync.Mutex
+	subscribers        map[string][]chan []*api.AgentService
+	selMu              sync.Mutex
+	selectors          map[string]Selector
+	filterMu           sync.Mutex
+	filters            map[string]ServiceFilter
+	ctx                context.Context
+	cancel             context.CancelFunc
+	wg                 sync.WaitGroup
+	alreadyRunning     bool
+	ticker             *time.Ticker
+	consulAddress      string
+	apiConfig          *api.Config
+	logger             Logger
+	metrics            Metrics
+	ErrorChan          chan error
+	SuccessChan        chan bool
+	serviceRetriever   ServiceRetriever
+	healthQueryFunc    HealthQuery
+	refreshIntervall   time.Duration
+	stalenessTolerance time.Duration
 }
 
+// instance is the default cache backing the package-level functions
+// (Configure, Start, GetServiceInstance, ...), kept for backward
+// compatibility. New code should call New instead, so a process can run
+// several independent caches (e.g. one per datacenter) side by side.
 var instance = &ConsulCache{}
 
 func (cache *ConsulCache) SetServiceRetriever(r ServiceRetriever) error {
@@ -35,23 +58,97 @@ func (cache *ConsulCache) SetServiceRetriever(r ServiceRetriever) error {
 	return nil
 }
 
-func getFromServer(consulAddress string) (map[string]*api.AgentService, error) {
-	client, consulErr := getClient(consulAddress)
-	if consulErr != nil {
-		return nil, consulErr
+// defaultRetriever is the ServiceRetriever every cache starts out with. It
+// queries Consul's health endpoint per watched service (honoring each
+// service's ServiceFilter, or defaultServiceFilter if none was set), so the
+// cache reflects the whole cluster rather than just the local agent, and
+// excludes failing instances unless told otherwise.
+//
+// A health query failing for one service doesn't abort the rest: every
+// other service's result is still gathered and returned alongside a
+// combined error, so a single flaky service doesn't make RefreshCtx treat
+// the whole tick as a total failure.
+func (cache *ConsulCache) defaultRetriever(ctx context.Context, consulAddress string) (map[string]*api.AgentService, error) {
+	cache.RLock()
+	names := make([]string, 0, len(cache.serviceMap))
+	for name := range cache.serviceMap {
+		names = append(names, name)
 	}
-	catalog := client.Agent()
-	services, err := catalog.Services()
-	if err != nil {
-		return nil, err
+	cache.RUnlock()
+
+	result := make(map[string]*api.AgentService, 0)
+	var failed []string
+	for _, name := range names {
+		instances, _, err := cache.healthQueryFunc(ctx, name, cache.filterFor(name), 0, 0)
+		if err != nil {
+			failed = append(failed, name)
+			continue
+		}
+		for _, instance := range instances {
+			result[instance.ID] = instance
+		}
 	}
-	return services, nil
+	if len(failed) > 0 {
+		return result, errors.New(fmt.Sprintf("failed to query health for %v", failed))
+	}
+	return result, nil
+}
+
+// init wires up the maps, channels and retriever shared by Configure and
+// New, leaving only their differing construction of apiConfig to the
+// caller.
+func (cache *ConsulCache) init(apiConfig *api.Config, refreshIntervall time.Duration, services []string) {
+	cache.RWMutex = new(sync.RWMutex)
+	cache.apiConfig = apiConfig
+	cache.consulAddress = apiConfig.Address
+	cache.serviceRetriever = cache.defaultRetriever
+	cache.healthQueryFunc = cache.defaultHealthQuery
+	cache.serviceMap = make(map[string][]*api.AgentService, 0)
+	cache.serviceVersions = make(map[string]uint64, 0)
+	cache.lastSuccess = make(map[string]time.Time, 0)
+	cache.subscribers = make(map[string][]chan []*api.AgentService, 0)
+	cache.selectors = make(map[string]Selector, 0)
+	cache.filters = make(map[string]ServiceFilter, 0)
+	cache.SuccessChan = make(chan bool)
+	cache.ErrorChan = make(chan error)
+	cache.refreshIntervall = refreshIntervall
+	if cache.logger == nil {
+		cache.logger = NewStdLogger(nil)
+	}
+	if cache.metrics == nil {
+		cache.metrics = noopMetrics{}
+	}
+	cache.WatchServices(services...)
+}
+
+// SetLogger configures the Logger used for the cache's diagnostic output.
+func (cache *ConsulCache) SetLogger(logger Logger) {
+	cache.logger = logger
+}
+
+// SetMetrics configures the Metrics sink that records refresh and
+// GetServiceInstance activity. A freshly constructed cache starts out with a
+// no-op Metrics, so wiring one in is optional.
+func (cache *ConsulCache) SetMetrics(metrics Metrics) {
+	cache.metrics = metrics
+}
+
+// SetStalenessTolerance configures how long a watched service may go
+// without a successful refresh before RefreshCtx evicts its (stale)
+// instances instead of continuing to serve them. d <= 0 means never evict on
+// staleness alone, which is also the default.
+func (cache *ConsulCache) SetStalenessTolerance(d time.Duration) {
+	cache.stalenessTolerance = d
 }
 
 func Stop() bool {
 	return instance.Stop()
 }
 
+// Stop cancels the cache's root context and blocks until tickerLoop and
+// every watchService goroutine have actually exited, so a subsequent
+// Start/StartCtx never overwrites cache.ticker/cache.ctx/cache.cancel out
+// from under a goroutine that's still reading them.
 func (cache *ConsulCache) Stop() bool {
 
 	if !cache.alreadyRunning {
@@ -59,12 +156,8 @@ func (cache *ConsulCache) Stop() bool {
 	}
 	cache.alreadyRunning = false
 	cache.ticker.Stop()
-	select {
-	case cache.abortChan <- true:
-		break
-	default:
-		break
-	}
+	cache.cancel()
+	cache.wg.Wait()
 	return true
 }
 
@@ -94,18 +187,17 @@ func GetInstance() *ConsulCache {
 	return instance
 }
 
+// Configure sets up the default package-level cache.
+//
+// Deprecated: use New instead, which returns an independent *ConsulCache and
+// lets a process run more than one cache (e.g. one per datacenter) at once.
 func Configure(consulAddress string, refreshIntervall time.Duration, services ...string) (*ConsulCache, error) {
 	if instance.alreadyRunning {
 		return nil, errors.New("cannot configure running cache.")
 	}
-	instance.RWMutex = new(sync.RWMutex)
-	instance.consulAddress = consulAddress
-	instance.serviceRetriever = getFromServer
-	instance.serviceMap = make(map[string][]*api.AgentService, 0)
-	instance.SuccessChan = make(chan bool)
-	instance.ErrorChan = make(chan error)
-	instance.WatchServices(services...)
-	instance.refreshIntervall = refreshIntervall
+	apiConfig := api.DefaultConfig()
+	apiConfig.Address = consulAddress
+	instance.init(apiConfig, refreshIntervall, services)
 	return instance, nil
 }
 
@@ -114,12 +206,21 @@ func Start(maxRetries int, retryTimeout time.Duration) error {
 }
 
 func (cache *ConsulCache) Start(maxRetries int, retryTimeout time.Duration) error {
-	err := cache.RefreshAndRestart()
+	return cache.StartCtx(context.Background(), maxRetries, retryTimeout)
+}
+
+// StartCtx behaves like Start, but ctx becomes the cache's root context: it
+// is carried into every retrieval performed by the ticker loop and the
+// per-service watchers, and canceling it (or calling Stop) tears all of them
+// down deterministically instead of relying on a best-effort abort signal.
+func (cache *ConsulCache) StartCtx(ctx context.Context, maxRetries int, retryTimeout time.Duration) error {
+	cache.ctx, cache.cancel = context.WithCancel(ctx)
+	err := cache.RefreshAndRestartCtx(cache.ctx)
 	if err != nil {
 		for i := 0; i < maxRetries; i++ {
 			select {
 			case err := <-cache.ErrorChan:
-				log.Println(err)
+				cache.logger.With("attempt", i+1).Errorf("refresh failed: %v", err)
 				time.Sleep(retryTimeout)
 			case running := <-cache.SuccessChan:
 				cache.alreadyRunning = running
@@ -134,6 +235,7 @@ func (cache *ConsulCache) Start(maxRetries int, retryTimeout time.Duration) erro
 	if !cache.alreadyRunning {
 		return errors.New("unable to start cache.")
 	}
+	cache.startWatchers()
 	return nil
 }
 
@@ -142,7 +244,11 @@ func RefreshAndRestart() error {
 }
 
 func (cache *ConsulCache) RefreshAndRestart() error {
-	err := cache.Refresh()
+	return cache.RefreshAndRestartCtx(context.Background())
+}
+
+func (cache *ConsulCache) RefreshAndRestartCtx(ctx context.Context) error {
+	err := cache.RefreshCtx(ctx)
 	cache.RestartTicker()
 	return err
 }
@@ -150,45 +256,39 @@ func (cache *ConsulCache) RefreshAndRestart() error {
 func (cache *ConsulCache) RestartTicker() {
 	if cache.ticker != nil {
 		cache.ticker.Stop()
-		select {
-		case cache.abortChan <- true:
-			break
-		default:
-			break
-		}
 	}
 	cache.ticker = time.NewTicker(cache.refreshIntervall)
+	cache.wg.Add(1)
 	go tickerLoop(cache)
 }
 
+// tickerLoop is the fallback poll driven by cache.ticker; watchService is
+// the primary update path once it's running (see watch.go). ErrorChan and
+// SuccessChan are only drained by StartCtx's own retry loop, which exits as
+// soon as the cache reports running, so both sends below are non-blocking:
+// a blocking send here would hang this goroutine (and therefore Stop's
+// wg.Wait()) on the first tick after Start succeeds.
 func tickerLoop(cache *ConsulCache) {
-	breakLoop := false
+	defer cache.wg.Done()
 	for {
 		select {
 		case <-cache.ticker.C:
-			err := cache.Refresh()
+			err := cache.RefreshCtx(cache.ctx)
 			if err != nil {
-				cache.ErrorChan <- err
+				select {
+				case cache.ErrorChan <- err:
+				default:
+				}
 				continue
 			}
-			cache.SuccessChan <- true
-		case breakLoop = <-cache.abortChan:
-			break
-		}
-		if breakLoop {
-			break
-		}
-	}
-}
-
-func (cache *ConsulCache) verifyResult() error {
-	for key, service := range cache.serviceMap {
-		if len(service) < 1 {
-			return errors.New(fmt.Sprintf("could not refresh %s", key))
+			select {
+			case cache.SuccessChan <- true:
+			default:
+			}
+		case <-cache.ctx.Done():
+			return
 		}
 	}
-	return nil
-
 }
 
 func Refresh() error {
@@ -196,25 +296,63 @@ func Refresh() error {
 }
 
 func (cache *ConsulCache) Refresh() error {
-	services, err := cache.serviceRetriever(cache.consulAddress)
-	if err != nil {
-		return err
+	return cache.RefreshCtx(context.Background())
+}
+
+// RefreshCtx behaves like Refresh, but aborts the underlying retrieval as
+// soon as ctx is done instead of blocking until the configured Consul
+// retriever returns on its own.
+//
+// The retriever's result is assembled into a candidate snapshot off-lock and
+// only swapped into serviceMap, one service at a time, under the write
+// lock - a failed or partial refresh never wipes a service's data out from
+// under a concurrent GetServiceInstance. retrieverErr doesn't stop the
+// services it did return from being applied: a ServiceRetriever (like
+// defaultRetriever) that fails one service out of many still reports the
+// rest, and those still count as a success for their own service. A watched
+// service missing from the result keeps serving its previous (now stale)
+// instances unless they've been stale longer than StalenessTolerance, in
+// which case they're evicted instead of served indefinitely.
+// StalenessTolerance <= 0 (the default) means stale data is never evicted on
+// its own.
+func (cache *ConsulCache) RefreshCtx(ctx context.Context) error {
+	start := time.Now()
+	services, retrieverErr := cache.serviceRetriever(ctx, cache.consulAddress)
+	duration := time.Since(start)
+
+	next := make(map[string][]*api.AgentService)
+	for _, service := range services {
+		next[service.Service] = append(next[service.Service], service)
 	}
+
+	now := time.Now()
 	cache.Lock()
 	defer cache.Unlock()
-	cache.clear()
-	for _, service := range services {
-		if val, ok := cache.serviceMap[service.Service]; ok {
-			cache.serviceMap[service.Service] = append(val, service)
+
+	var stale []string
+	for name := range cache.serviceMap {
+		if instances, ok := next[name]; ok && len(instances) > 0 {
+			cache.serviceMap[name] = instances
+			cache.lastSuccess[name] = now
+			cache.metrics.RefreshOk(name, duration, len(instances))
+			cache.refreshSelector(name, instances)
+			continue
+		}
+
+		stale = append(stale, name)
+		cache.metrics.RefreshError(name)
+		if cache.stalenessTolerance > 0 && now.Sub(cache.lastSuccess[name]) > cache.stalenessTolerance {
+			cache.serviceMap[name] = nil
 		}
 	}
-	return cache.verifyResult()
-}
 
-func (cache *ConsulCache) clear() {
-	for k, _ := range cache.serviceMap {
-		cache.serviceMap[k] = nil
+	if retrieverErr != nil {
+		return retrieverErr
 	}
+	if len(stale) > 0 {
+		return errors.New(fmt.Sprintf("could not refresh %v, serving previous snapshot", stale))
+	}
+	return nil
 }
 
 func WatchServices(serviceNames ...string) {
@@ -223,10 +361,22 @@ func WatchServices(serviceNames ...string) {
 
 func (cache *ConsulCache) WatchServices(serviceNames ...string) {
 	cache.Lock()
-	defer cache.Unlock()
+	newServices := make([]string, 0, len(serviceNames))
 	for _, service := range serviceNames {
+		if _, ok := cache.serviceMap[service]; !ok {
+			newServices = append(newServices, service)
+		}
 		cache.serviceMap[service] = make([]*api.AgentService, 0)
 	}
+	running := cache.alreadyRunning
+	cache.Unlock()
+
+	if running {
+		for _, service := range newServices {
+			cache.wg.Add(1)
+			go cache.watchService(service)
+		}
+	}
 }
 
 func GetServiceAddress(serviceName string) (string, error) {
@@ -234,7 +384,11 @@ func GetServiceAddress(serviceName string) (string, error) {
 }
 
 func (cache *ConsulCache) GetServiceAddress(serviceName string) (string, error) {
-	instance, err := cache.GetServiceInstance(serviceName)
+	return cache.GetServiceAddressCtx(context.Background(), serviceName)
+}
+
+func (cache *ConsulCache) GetServiceAddressCtx(ctx context.Context, serviceName string) (string, error) {
+	instance, err := cache.GetServiceInstanceCtx(ctx, serviceName)
 	if err != nil {
 		return "", err
 	}
@@ -246,33 +400,39 @@ func GetServiceInstance(serviceName string) (*api.AgentService, error) {
 }
 
 func (cache *ConsulCache) GetServiceInstance(serviceName string) (*api.AgentService, error) {
+	return cache.GetServiceInstanceCtx(context.Background(), serviceName)
+}
+
+// GetServiceInstanceCtx behaves like GetServiceInstance, but honors ctx's
+// deadline/cancellation for the fallback refresh it triggers on an empty
+// cache entry instead of blocking on a stuck Consul indefinitely.
+func (cache *ConsulCache) GetServiceInstanceCtx(ctx context.Context, serviceName string) (*api.AgentService, error) {
 	cache.RLock()
 	val, ok := cache.serviceMap[serviceName]
 	cache.RUnlock()
 	if ok {
 		if len(val) == 0 {
-			log.Printf("initial request for service %s\n", serviceName)
-			cache.Refresh()
+			cache.logger.With("service", serviceName).Infof("initial request for service")
+			cache.RefreshCtx(ctx)
 			cache.RLock()
 			val, ok = cache.serviceMap[serviceName]
 			cache.RUnlock()
 			if len(val) == 0 {
-				return nil, errors.New("Requested Service is not avaiable")
+				cache.metrics.GetEmpty(serviceName)
+				return nil, errorServiceNotAvailable
 			}
 		}
-		//return random service
-		return val[rand.Intn(len(val))], nil
+		cache.metrics.GetHit(serviceName)
+		instance := cache.selectorFor(serviceName).Select(val)
+		cache.logger.With("service", serviceName, "instance_id", instance.ID).Debugf("selected instance")
+		return instance, nil
 
 	}
-	return nil, errors.New("Requested unregistered service")
+	cache.metrics.GetMiss(serviceName)
+	return nil, errorServiceNotRegistered
 }
 
-func getClient(address string) (*api.Client, error) {
-	config := api.DefaultConfig()
-	config.Address = address
-	client, consulError := api.NewClient(config)
-	if consulError != nil {
-		return client, consulError
-	}
-	return client, nil
+// client returns a Consul API client built from cache.apiConfig.
+func (cache *ConsulCache) client() (*api.Client, error) {
+	return api.NewClient(cache.apiConfig)
 }
@@ -1,9 +1,13 @@
 package servicecache
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/hashicorp/consul/api"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -58,6 +62,33 @@ func TestRefreshFail(t *testing.T) {
 	fmt.Println("TestRefreshCacheFail done")
 }
 
+func TestRefreshPartialFailureKeepsHealthyServices(t *testing.T) {
+
+	fmt.Println("TestRefreshPartialFailureKeepsHealthyServices")
+	cache, _ := Configure("discovery:8500", 1*time.Millisecond, "authentication-service", "acl-service")
+
+	healthy := createService("1", "authentication-service", 80, "192.168.2.1")
+	partialRetriever := func(ctx context.Context, consulAddress string) (map[string]*api.AgentService, error) {
+		return map[string]*api.AgentService{"1": healthy}, errors.New("acl-service: boom")
+	}
+	if err := cache.SetServiceRetriever(partialRetriever); err != nil {
+		t.Error("expected no error, got ", err)
+	}
+
+	if err := cache.Refresh(); err == nil {
+		t.Error("expected an error reporting the service the retriever failed to refresh")
+	}
+
+	instance, instanceErr := cache.GetServiceInstance("authentication-service")
+	if instanceErr != nil {
+		t.Error("expected the service the retriever did refresh to still be served, got ", instanceErr)
+	} else if instance.ID != "1" {
+		t.Error("expected the instance returned by the partially failing refresh, got ", instance.ID)
+	}
+
+	fmt.Println("TestRefreshPartialFailureKeepsHealthyServices done")
+}
+
 func TestStartStop(t *testing.T) {
 
 	fmt.Println("TestStartStop ")
@@ -148,6 +179,144 @@ func TestGetServiceAddress(t *testing.T) {
 	fmt.Println("TestGetServiceAddress done")
 }
 
+func TestWatchServiceUsesInjectedHealthQuery(t *testing.T) {
+
+	fmt.Println("TestWatchServiceUsesInjectedHealthQuery")
+	cache, _ := Configure("discovery:8500", 1*time.Millisecond, "authentication-service")
+	err := cache.SetServiceRetriever(fakeRetriever)
+	if err != nil {
+		t.Error("expected no error, got ", err)
+	}
+
+	var calls int32
+	injected := createService("injected", "authentication-service", 80, "192.168.2.100")
+	err = cache.SetHealthQuery(func(ctx context.Context, serviceName string, filter ServiceFilter, waitIndex uint64, waitTime time.Duration) ([]*api.AgentService, uint64, error) {
+		atomic.AddInt32(&calls, 1)
+		if waitIndex == 0 {
+			return []*api.AgentService{injected}, 1, nil
+		}
+		<-ctx.Done()
+		return nil, waitIndex, ctx.Err()
+	})
+	if err != nil {
+		t.Error("expected no error, got ", err)
+	}
+
+	ch, cancel := cache.Subscribe("authentication-service")
+	defer cancel()
+
+	if err := cache.Start(3, 1*time.Millisecond); err != nil {
+		t.Error("encountered error while starting cache: ", err)
+	}
+	defer cache.Stop()
+
+	select {
+	case instances := <-ch:
+		if len(instances) != 1 || instances[0].ID != "injected" {
+			t.Error("expected the watcher to publish the instance from the injected HealthQuery")
+		}
+	case <-time.After(time.Second):
+		t.Error("timed out waiting for watchService to use the injected HealthQuery")
+	}
+
+	if atomic.LoadInt32(&calls) < 1 {
+		t.Error("expected the injected HealthQuery to be called")
+	}
+
+	fmt.Println("TestWatchServiceUsesInjectedHealthQuery done")
+}
+
+// recordingMetrics counts RefreshOk calls so tests can assert watchService
+// feeds the same bookkeeping RefreshCtx does, without pulling in Prometheus.
+type recordingMetrics struct {
+	mu        sync.Mutex
+	refreshOk int
+}
+
+func (m *recordingMetrics) RefreshOk(service string, duration time.Duration, instanceCount int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refreshOk++
+}
+func (m *recordingMetrics) RefreshError(service string) {}
+func (m *recordingMetrics) GetHit(service string)       {}
+func (m *recordingMetrics) GetMiss(service string)      {}
+func (m *recordingMetrics) GetEmpty(service string)     {}
+
+func (m *recordingMetrics) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.refreshOk
+}
+
+func TestWatchServiceRecordsMetricsAndLastSuccess(t *testing.T) {
+
+	fmt.Println("TestWatchServiceRecordsMetricsAndLastSuccess")
+	cache, _ := Configure("discovery:8500", 1*time.Millisecond, "authentication-service")
+	// Only the initial refresh made by Start returns the service; the ticker's
+	// later refreshes don't, so they record neither RefreshOk nor lastSuccess
+	// and anything recorded after the baseline below comes from watchService.
+	var retrieved int32
+	err := cache.SetServiceRetriever(func(ctx context.Context, consulAddress string) (map[string]*api.AgentService, error) {
+		if atomic.AddInt32(&retrieved, 1) == 1 {
+			return fakeRetriever(ctx, consulAddress)
+		}
+		return map[string]*api.AgentService{}, nil
+	})
+	if err != nil {
+		t.Error("expected no error, got ", err)
+	}
+
+	metrics := &recordingMetrics{}
+	cache.SetMetrics(metrics)
+
+	release := make(chan struct{})
+	injected := createService("injected", "authentication-service", 80, "192.168.2.100")
+	err = cache.SetHealthQuery(func(ctx context.Context, serviceName string, filter ServiceFilter, waitIndex uint64, waitTime time.Duration) ([]*api.AgentService, uint64, error) {
+		if waitIndex == 0 {
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return nil, waitIndex, ctx.Err()
+			}
+			return []*api.AgentService{injected}, 1, nil
+		}
+		<-ctx.Done()
+		return nil, waitIndex, ctx.Err()
+	})
+	if err != nil {
+		t.Error("expected no error, got ", err)
+	}
+
+	if err := cache.Start(3, 1*time.Millisecond); err != nil {
+		t.Error("encountered error while starting cache: ", err)
+	}
+	defer cache.Stop()
+
+	baseline := metrics.count()
+	cache.RLock()
+	before := cache.lastSuccess["authentication-service"]
+	cache.RUnlock()
+	close(release)
+
+	deadline := time.Now().Add(time.Second)
+	for metrics.count() == baseline && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if metrics.count() == baseline {
+		t.Error("expected watchService to record a RefreshOk for its successful query")
+	}
+
+	cache.RLock()
+	after := cache.lastSuccess["authentication-service"]
+	cache.RUnlock()
+	if !after.After(before) {
+		t.Error("expected watchService to record lastSuccess for the watched service")
+	}
+
+	fmt.Println("TestWatchServiceRecordsMetricsAndLastSuccess done")
+}
+
 func createService(id string, service string, port int, address string, tags ...string) *api.AgentService {
 	return &api.AgentService{
 		ID:      id,
@@ -159,7 +328,7 @@ func createService(id string, service string, port int, address string, tags ...
 
 }
 
-func fakeRetriever(consulAddress string) (map[string]*api.AgentService, error) {
+func fakeRetriever(ctx context.Context, consulAddress string) (map[string]*api.AgentService, error) {
 	services := make(map[string]*api.AgentService)
 
 	for i := 1; i < 4; i++ {
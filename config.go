@@ -0,0 +1,73 @@
+package servicecache
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Config carries everything needed to construct an independent ConsulCache
+// via New. It is mapped onto an api.Config when the Consul client is built.
+type Config struct {
+	// Address is the Consul HTTP API address, e.g. "localhost:8500".
+	Address string
+	// Datacenter restricts queries to a single Consul datacenter. Empty
+	// means Consul's own default (the agent's local datacenter).
+	Datacenter string
+	// Token is the ACL token sent with every request, if any.
+	Token string
+	// Scheme is "http" or "https". Empty means api.DefaultConfig's default.
+	Scheme string
+	// RefreshInterval is both the period of the fallback ticker poll
+	// (re)started by Start/RefreshAndRestart and the wait time of the
+	// blocking queries issued by the per-service watchers.
+	RefreshInterval time.Duration
+	// HTTPClient, if set, replaces the http.Client used to talk to Consul.
+	HTTPClient *http.Client
+	// Logger, if set, receives the cache's diagnostic output instead of
+	// the standard log package. Wrap a *log.Logger with NewStdLogger, or
+	// provide your own Logger backed by zap/logrus.
+	Logger Logger
+	// Metrics, if set, receives refresh and GetServiceInstance counters
+	// and gauges. NewPrometheusMetrics returns a ready-made prometheus.Collector
+	// implementing it.
+	Metrics Metrics
+	// StalenessTolerance bounds how long a watched service may go without
+	// a successful refresh before its stale instances are evicted rather
+	// than kept in serviceMap. Zero (the default) means they're kept
+	// indefinitely.
+	StalenessTolerance time.Duration
+	// Services are watched from the moment the cache is constructed, same
+	// as the variadic services passed to Configure.
+	Services []string
+}
+
+// New constructs an independent *ConsulCache from cfg. Unlike Configure, the
+// returned cache shares no state with the package-level default instance, so
+// a process can run several caches side by side (e.g. one per datacenter).
+func New(cfg Config) (*ConsulCache, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("servicecache: Config.Address is required")
+	}
+
+	apiConfig := api.DefaultConfig()
+	apiConfig.Address = cfg.Address
+	if cfg.Datacenter != "" {
+		apiConfig.Datacenter = cfg.Datacenter
+	}
+	if cfg.Token != "" {
+		apiConfig.Token = cfg.Token
+	}
+	if cfg.Scheme != "" {
+		apiConfig.Scheme = cfg.Scheme
+	}
+	if cfg.HTTPClient != nil {
+		apiConfig.HttpClient = cfg.HTTPClient
+	}
+
+	cache := &ConsulCache{logger: cfg.Logger, metrics: cfg.Metrics, stalenessTolerance: cfg.StalenessTolerance}
+	cache.init(apiConfig, cfg.RefreshInterval, cfg.Services)
+	return cache, nil
+}
@@ -0,0 +1,50 @@
+package servicecache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNewRequiresAddress(t *testing.T) {
+
+	fmt.Println("TestNewRequiresAddress")
+	_, err := New(Config{})
+	if err == nil {
+		t.Error("expected an error when Config.Address is empty")
+	}
+
+	fmt.Println("TestNewRequiresAddress done")
+}
+
+func TestNewIsIndependentFromTheDefaultInstance(t *testing.T) {
+
+	fmt.Println("TestNewIsIndependentFromTheDefaultInstance")
+	cache, err := New(Config{
+		Address:         "discovery:8500",
+		RefreshInterval: time.Millisecond,
+		Services:        []string{"authentication-service"},
+	})
+	if err != nil {
+		t.Error("expected no error, got ", err)
+	}
+	if !cache.IsWatched("authentication-service") {
+		t.Error("expected authentication-service to be watched on the new cache")
+	}
+
+	if err := cache.SetServiceRetriever(fakeRetriever); err != nil {
+		t.Error("expected no error, got ", err)
+	}
+	if err := cache.Refresh(); err != nil {
+		t.Error("expected no error, got ", err)
+	}
+	if _, err := cache.GetServiceInstance("authentication-service"); err != nil {
+		t.Error("expected no error, got ", err)
+	}
+
+	if cache == GetInstance() {
+		t.Error("expected New to return a cache distinct from the package-level default instance")
+	}
+
+	fmt.Println("TestNewIsIndependentFromTheDefaultInstance done")
+}
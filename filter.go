@@ -0,0 +1,162 @@
+package servicecache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ServiceFilter narrows which instances of a watched service the cache
+// considers. It is applied server-side, as arguments to Consul's
+// /v1/health/service endpoint, not by filtering an already-fetched slice.
+type ServiceFilter struct {
+	// Tags lists tags an instance must carry, ANDed together.
+	Tags []string
+	// PassingOnly excludes instances with a failing/critical health check.
+	PassingOnly bool
+	// NodeMeta restricts results to nodes carrying all of these
+	// meta key/value pairs.
+	NodeMeta map[string]string
+	// Near sorts results by network-coordinate distance to this node
+	// ("_agent" is a valid Consul placeholder for the local agent).
+	Near string
+}
+
+// defaultServiceFilter is used for any watched service that was registered
+// through WatchServices rather than WatchServiceWithFilter: no tag
+// restriction, but only passing instances, matching the cache's goal of
+// being a real discovery layer rather than an agent-local snapshot.
+var defaultServiceFilter = ServiceFilter{PassingOnly: true}
+
+// WatchServiceWithFilter starts watching serviceName like WatchServices,
+// but restricts the instances the cache keeps for it to those matching
+// filter.
+func (cache *ConsulCache) WatchServiceWithFilter(serviceName string, filter ServiceFilter) {
+	cache.filterMu.Lock()
+	cache.filters[serviceName] = filter
+	cache.filterMu.Unlock()
+	cache.WatchServices(serviceName)
+}
+
+// filterFor returns the ServiceFilter configured for serviceName via
+// WatchServiceWithFilter, or defaultServiceFilter if none was set.
+func (cache *ConsulCache) filterFor(serviceName string) ServiceFilter {
+	cache.filterMu.Lock()
+	defer cache.filterMu.Unlock()
+	if f, ok := cache.filters[serviceName]; ok {
+		return f
+	}
+	return defaultServiceFilter
+}
+
+// HealthQuery looks up the instances of serviceName matching filter,
+// honoring the blocking-query parameters (waitIndex/waitTime). It is the
+// seam both defaultRetriever and watchService query through, so tests (or
+// alternative discovery backends) can swap it out via SetHealthQuery without
+// a live Consul.
+type HealthQuery func(ctx context.Context, serviceName string, filter ServiceFilter, waitIndex uint64, waitTime time.Duration) ([]*api.AgentService, uint64, error)
+
+// SetHealthQuery replaces the HealthQuery used by defaultRetriever and every
+// watchService goroutine. Like SetServiceRetriever, it can't be changed once
+// the cache is running, since watchService goroutines would already be
+// using the previous one.
+func (cache *ConsulCache) SetHealthQuery(q HealthQuery) error {
+	if cache.alreadyRunning {
+		return errors.New("can't change health query on running cache")
+	}
+	cache.healthQueryFunc = q
+	return nil
+}
+
+// defaultHealthQuery issues a single Health().Service call for serviceName
+// applying filter and the blocking-query parameters (waitIndex/waitTime),
+// returning the plain AgentService instances Consul reports as matching.
+func (cache *ConsulCache) defaultHealthQuery(ctx context.Context, serviceName string, filter ServiceFilter, waitIndex uint64, waitTime time.Duration) ([]*api.AgentService, uint64, error) {
+	client, err := cache.client()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tag := ""
+	if len(filter.Tags) == 1 {
+		tag = filter.Tags[0]
+	}
+
+	opts := &api.QueryOptions{
+		WaitIndex: waitIndex,
+		WaitTime:  waitTime,
+		NodeMeta:  filter.NodeMeta,
+		Near:      filter.Near,
+	}
+	if len(filter.Tags) > 1 {
+		opts.Filter = tagsFilterExpression(filter.Tags)
+	}
+	opts = opts.WithContext(ctx)
+
+	entries, meta, err := client.Health().Service(serviceName, tag, filter.PassingOnly, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	instances := make([]*api.AgentService, 0, len(entries))
+	for _, entry := range entries {
+		instances = append(instances, entry.Service)
+	}
+	return instances, meta.LastIndex, nil
+}
+
+// tagsFilterExpression builds a Consul filter expression (see
+// https://www.consul.io/api-docs/features/filtering) requiring every tag in
+// tags to be present on the service.
+func tagsFilterExpression(tags []string) string {
+	clauses := make([]string, len(tags))
+	for i, tag := range tags {
+		clauses[i] = `"` + tag + `" in ServiceTags`
+	}
+	return strings.Join(clauses, " and ")
+}
+
+// hasAllTags reports whether instance carries every tag in tags.
+func hasAllTags(instance *api.AgentService, tags []string) bool {
+	for _, want := range tags {
+		found := false
+		for _, got := range instance.Tags {
+			if got == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// GetServiceInstanceFiltered behaves like GetServiceInstance, but further
+// restricts the selection to cached instances carrying every tag in tags.
+// Unlike ServiceFilter (applied server-side when the cache refreshes), this
+// filters the already-cached slice at call time. Unlike GetServiceInstance,
+// it does not trigger a refresh when the cached slice is empty.
+func (cache *ConsulCache) GetServiceInstanceFiltered(serviceName string, tags ...string) (*api.AgentService, error) {
+	cache.RLock()
+	val, ok := cache.serviceMap[serviceName]
+	cache.RUnlock()
+	if !ok {
+		return nil, errorServiceNotRegistered
+	}
+
+	matching := make([]*api.AgentService, 0, len(val))
+	for _, instance := range val {
+		if hasAllTags(instance, tags) {
+			matching = append(matching, instance)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, errorServiceNotAvailable
+	}
+	return cache.selectorFor(serviceName).Select(matching), nil
+}
@@ -0,0 +1,68 @@
+package servicecache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestTagsFilterExpression(t *testing.T) {
+
+	fmt.Println("TestTagsFilterExpression")
+	got := tagsFilterExpression([]string{"canary", "us-east"})
+	want := `"canary" in ServiceTags and "us-east" in ServiceTags`
+	if got != want {
+		t.Error("expected ", want, " got ", got)
+	}
+
+	fmt.Println("TestTagsFilterExpression done")
+}
+
+func TestHasAllTags(t *testing.T) {
+
+	fmt.Println("TestHasAllTags")
+	instance := createService("1", "authentication-service", 80, "192.168.2.1", "canary", "us-east")
+
+	if !hasAllTags(instance, []string{"canary"}) {
+		t.Error("expected instance carrying canary to match")
+	}
+	if hasAllTags(instance, []string{"canary", "us-west"}) {
+		t.Error("expected instance missing us-west to not match")
+	}
+
+	fmt.Println("TestHasAllTags done")
+}
+
+func TestGetServiceInstanceFiltered(t *testing.T) {
+
+	fmt.Println("TestGetServiceInstanceFiltered")
+	cache, _ := Configure("discovery:8500", 1*time.Millisecond, "authentication-service")
+
+	canary := createService("1", "authentication-service", 80, "192.168.2.1", "canary")
+	stable := createService("2", "authentication-service", 80, "192.168.2.2", "stable")
+	retriever := func(ctx context.Context, consulAddress string) (map[string]*api.AgentService, error) {
+		return map[string]*api.AgentService{"1": canary, "2": stable}, nil
+	}
+	if err := cache.SetServiceRetriever(retriever); err != nil {
+		t.Error("expected no error, got ", err)
+	}
+	if err := cache.Refresh(); err != nil {
+		t.Error("expected no error, got ", err)
+	}
+
+	instance, err := cache.GetServiceInstanceFiltered("authentication-service", "canary")
+	if err != nil {
+		t.Error("expected no error, got ", err)
+	} else if instance.ID != "1" {
+		t.Error("expected the canary instance, got ", instance.ID)
+	}
+
+	if _, err := cache.GetServiceInstanceFiltered("authentication-service", "us-west"); err == nil {
+		t.Error("expected an error when no cached instance carries the requested tag")
+	}
+
+	fmt.Println("TestGetServiceInstanceFiltered done")
+}
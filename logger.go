@@ -0,0 +1,59 @@
+package servicecache
+
+import (
+	"fmt"
+	"log"
+)
+
+// Logger is the structured logging sink used for the cache's diagnostic
+// output. The four level methods match logrus.Logger (and zap's
+// SugaredLogger), and With mirrors SugaredLogger.With, so either can be
+// wrapped in a couple of lines; NewStdLogger needs neither and is what the
+// cache falls back to when none is configured.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	// With returns a Logger that appends the given alternating key/value
+	// pairs (e.g. "service", serviceName) to every subsequent call.
+	With(keysAndValues ...interface{}) Logger
+}
+
+// stdLogger adapts a *log.Logger to Logger, reproducing the cache's
+// behaviour from before Logger existed: everything goes through a single
+// *log.Logger, or the standard log package when l is nil.
+type stdLogger struct {
+	l      *log.Logger
+	fields []interface{}
+}
+
+// NewStdLogger returns a Logger backed by l. A nil l falls back to the
+// standard log package.
+func NewStdLogger(l *log.Logger) Logger {
+	return &stdLogger{l: l}
+}
+
+func (s *stdLogger) print(level, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if len(s.fields) > 0 {
+		msg = fmt.Sprintf("%s %v", msg, s.fields)
+	}
+	if s.l != nil {
+		s.l.Printf("[%s] %s", level, msg)
+		return
+	}
+	log.Printf("[%s] %s", level, msg)
+}
+
+func (s *stdLogger) Debugf(format string, args ...interface{}) { s.print("DEBUG", format, args...) }
+func (s *stdLogger) Infof(format string, args ...interface{})  { s.print("INFO", format, args...) }
+func (s *stdLogger) Warnf(format string, args ...interface{})  { s.print("WARN", format, args...) }
+func (s *stdLogger) Errorf(format string, args ...interface{}) { s.print("ERROR", format, args...) }
+
+func (s *stdLogger) With(keysAndValues ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(s.fields)+len(keysAndValues))
+	fields = append(fields, s.fields...)
+	fields = append(fields, keysAndValues...)
+	return &stdLogger{l: s.l, fields: fields}
+}
@@ -0,0 +1,50 @@
+package servicecache
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestStdLoggerWithAppendsFields(t *testing.T) {
+
+	fmt.Println("TestStdLoggerWithAppendsFields")
+	var buf bytes.Buffer
+	logger := NewStdLogger(log.New(&buf, "", 0))
+
+	logger.With("service", "authentication-service").Errorf("watch failed: %v", "boom")
+
+	out := buf.String()
+	if !strings.Contains(out, "[ERROR]") || !strings.Contains(out, "watch failed: boom") {
+		t.Error("expected level and message in output, got ", out)
+	}
+	if !strings.Contains(out, "service") || !strings.Contains(out, "authentication-service") {
+		t.Error("expected the With fields in output, got ", out)
+	}
+
+	fmt.Println("TestStdLoggerWithAppendsFields done")
+}
+
+func TestStdLoggerWithIsImmutableAcrossCalls(t *testing.T) {
+
+	fmt.Println("TestStdLoggerWithIsImmutableAcrossCalls")
+	var buf bytes.Buffer
+	base := NewStdLogger(log.New(&buf, "", 0))
+
+	withService := base.With("service", "authentication-service")
+	withService.With("instance_id", "1").Infof("selected instance")
+	buf.Reset()
+
+	withService.Infof("selected another instance")
+	out := buf.String()
+	if strings.Contains(out, "instance_id") {
+		t.Error("expected the instance_id field not to leak back into withService, got ", out)
+	}
+	if !strings.Contains(out, "service") {
+		t.Error("expected withService's own field to still be present, got ", out)
+	}
+
+	fmt.Println("TestStdLoggerWithIsImmutableAcrossCalls done")
+}
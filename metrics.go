@@ -0,0 +1,37 @@
+package servicecache
+
+import "time"
+
+// Metrics receives counters and gauges for the cache's refresh and lookup
+// activity, one call per service so a single Metrics can multiplex an
+// arbitrary sink (a Prometheus CollectorVec, a StatsD client, ...) across
+// every watched service. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// RefreshOk records a successful retrieval for service: how long it
+	// took and how many instances it returned. Implementations that want
+	// a cache-age gauge (seconds since the last successful refresh)
+	// derive it from the time of this call.
+	RefreshOk(service string, duration time.Duration, instanceCount int)
+	// RefreshError records a failed retrieval for service.
+	RefreshError(service string)
+	// GetHit records a GetServiceInstance call that returned a cached
+	// instance.
+	GetHit(service string)
+	// GetMiss records a GetServiceInstance call for a service that was
+	// never registered with the cache.
+	GetMiss(service string)
+	// GetEmpty records a GetServiceInstance call for a registered service
+	// whose instance slice was still empty after the fallback refresh.
+	GetEmpty(service string)
+}
+
+// noopMetrics discards everything. It is the Metrics a freshly constructed
+// cache starts out with, the same way NewStdLogger(nil) is its default
+// Logger, so wiring a real sink in is optional.
+type noopMetrics struct{}
+
+func (noopMetrics) RefreshOk(service string, duration time.Duration, instanceCount int) {}
+func (noopMetrics) RefreshError(service string)                                         {}
+func (noopMetrics) GetHit(service string)                                               {}
+func (noopMetrics) GetMiss(service string)                                              {}
+func (noopMetrics) GetEmpty(service string)                                             {}
@@ -0,0 +1,119 @@
+package servicecache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusMetrics is a Metrics implementation that exposes the cache's
+// refresh and lookup activity as a prometheus.Collector: refresh and
+// refresh-error counters, a refresh-duration histogram, an instance-count
+// gauge and a cache-age gauge (all per service), and a GetServiceInstance
+// counter split by result (hit, miss, empty). Register it with a
+// prometheus.Registerer before wiring it into a cache with SetMetrics or
+// Config.Metrics.
+type PrometheusMetrics struct {
+	refreshTotal      *prometheus.CounterVec
+	refreshErrorTotal *prometheus.CounterVec
+	refreshDuration   *prometheus.HistogramVec
+	instanceCount     *prometheus.GaugeVec
+	cacheAge          *prometheus.GaugeVec
+	getTotal          *prometheus.CounterVec
+
+	mu          sync.Mutex
+	lastRefresh map[string]time.Time
+}
+
+// NewPrometheusMetrics builds a PrometheusMetrics with every collector
+// namespaced under "consul_cache".
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		refreshTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "consul_cache",
+			Name:      "refresh_total",
+			Help:      "Number of successful service refreshes, by service.",
+		}, []string{"service"}),
+		refreshErrorTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "consul_cache",
+			Name:      "refresh_error_total",
+			Help:      "Number of failed service refreshes, by service.",
+		}, []string{"service"}),
+		refreshDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "consul_cache",
+			Name:      "refresh_duration_seconds",
+			Help:      "Duration of successful service refreshes, by service.",
+		}, []string{"service"}),
+		instanceCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "consul_cache",
+			Name:      "instance_count",
+			Help:      "Number of instances currently cached, by service.",
+		}, []string{"service"}),
+		cacheAge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "consul_cache",
+			Name:      "age_seconds",
+			Help:      "Seconds since the last successful refresh, by service.",
+		}, []string{"service"}),
+		getTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "consul_cache",
+			Name:      "get_instance_total",
+			Help:      "GetServiceInstance calls, by service and result (hit, miss, empty).",
+		}, []string{"service", "result"}),
+		lastRefresh: make(map[string]time.Time),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *PrometheusMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.refreshTotal.Describe(ch)
+	m.refreshErrorTotal.Describe(ch)
+	m.refreshDuration.Describe(ch)
+	m.instanceCount.Describe(ch)
+	m.cacheAge.Describe(ch)
+	m.getTotal.Describe(ch)
+}
+
+// Collect implements prometheus.Collector. The age gauge has no way to tick
+// up on its own between scrapes, so it's recomputed from lastRefresh right
+// before every collection instead.
+func (m *PrometheusMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.mu.Lock()
+	for service, last := range m.lastRefresh {
+		m.cacheAge.WithLabelValues(service).Set(time.Since(last).Seconds())
+	}
+	m.mu.Unlock()
+
+	m.refreshTotal.Collect(ch)
+	m.refreshErrorTotal.Collect(ch)
+	m.refreshDuration.Collect(ch)
+	m.instanceCount.Collect(ch)
+	m.cacheAge.Collect(ch)
+	m.getTotal.Collect(ch)
+}
+
+func (m *PrometheusMetrics) RefreshOk(service string, duration time.Duration, instanceCount int) {
+	m.refreshTotal.WithLabelValues(service).Inc()
+	m.refreshDuration.WithLabelValues(service).Observe(duration.Seconds())
+	m.instanceCount.WithLabelValues(service).Set(float64(instanceCount))
+
+	m.mu.Lock()
+	m.lastRefresh[service] = time.Now()
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) RefreshError(service string) {
+	m.refreshErrorTotal.WithLabelValues(service).Inc()
+}
+
+func (m *PrometheusMetrics) GetHit(service string) {
+	m.getTotal.WithLabelValues(service, "hit").Inc()
+}
+
+func (m *PrometheusMetrics) GetMiss(service string) {
+	m.getTotal.WithLabelValues(service, "miss").Inc()
+}
+
+func (m *PrometheusMetrics) GetEmpty(service string) {
+	m.getTotal.WithLabelValues(service, "empty").Inc()
+}
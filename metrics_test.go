@@ -0,0 +1,42 @@
+package servicecache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrometheusMetricsRecordsRefreshAndGetCounters(t *testing.T) {
+
+	fmt.Println("TestPrometheusMetricsRecordsRefreshAndGetCounters")
+	metrics := NewPrometheusMetrics()
+
+	metrics.RefreshOk("authentication-service", 5*time.Millisecond, 3)
+	metrics.RefreshError("acl-service")
+	metrics.GetHit("authentication-service")
+	metrics.GetMiss("lecture-service")
+	metrics.GetEmpty("authentication-service")
+
+	if got := testutil.ToFloat64(metrics.refreshTotal.WithLabelValues("authentication-service")); got != 1 {
+		t.Error("expected refreshTotal to be 1, got ", got)
+	}
+	if got := testutil.ToFloat64(metrics.refreshErrorTotal.WithLabelValues("acl-service")); got != 1 {
+		t.Error("expected refreshErrorTotal to be 1, got ", got)
+	}
+	if got := testutil.ToFloat64(metrics.instanceCount.WithLabelValues("authentication-service")); got != 3 {
+		t.Error("expected instanceCount to be 3, got ", got)
+	}
+	if got := testutil.ToFloat64(metrics.getTotal.WithLabelValues("authentication-service", "hit")); got != 1 {
+		t.Error("expected get_instance_total{result=hit} to be 1, got ", got)
+	}
+	if got := testutil.ToFloat64(metrics.getTotal.WithLabelValues("lecture-service", "miss")); got != 1 {
+		t.Error("expected get_instance_total{result=miss} to be 1, got ", got)
+	}
+	if got := testutil.ToFloat64(metrics.getTotal.WithLabelValues("authentication-service", "empty")); got != 1 {
+		t.Error("expected get_instance_total{result=empty} to be 1, got ", got)
+	}
+
+	fmt.Println("TestPrometheusMetricsRecordsRefreshAndGetCounters done")
+}
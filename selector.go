@@ -0,0 +1,372 @@
+package servicecache
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Selector picks one instance out of a service's currently cached instance
+// slice. It is called after the cache's read lock has been released, on the
+// instance slice read under that lock, so concurrent lookups may call Select
+// at the same time; it is not consulted under the lock.
+type Selector interface {
+	Select(instances []*api.AgentService) *api.AgentService
+}
+
+// Refreshable is implemented by selectors that want to precompute
+// per-service state from the current instance slice once per cache
+// refresh, instead of redoing that work on every Select call (e.g.
+// weightedRandomSelector's alias table). The cache calls Refresh right
+// after swapping a new instance slice into serviceMap (from both
+// RefreshCtx and watchService), so Refresh must not block or call back
+// into the cache.
+type Refreshable interface {
+	Refresh(instances []*api.AgentService)
+}
+
+// refreshSelector notifies serviceName's configured Selector that its
+// instance slice just changed, if that Selector implements Refreshable.
+func (cache *ConsulCache) refreshSelector(serviceName string, instances []*api.AgentService) {
+	if refreshable, ok := cache.selectorFor(serviceName).(Refreshable); ok {
+		refreshable.Refresh(instances)
+	}
+}
+
+// KeyedSelector is implemented by selectors that can route on a
+// caller-supplied key (sticky sessions, cache affinity, ...) in addition to
+// plain Select.
+type KeyedSelector interface {
+	Selector
+	SelectKey(key string, instances []*api.AgentService) *api.AgentService
+}
+
+// Releaser is implemented by selectors that track outstanding requests per
+// instance and need to be told when a caller is done with one.
+type Releaser interface {
+	Release(instanceID string)
+}
+
+// SetSelector configures the Selector used to pick an instance of
+// serviceName on every GetServiceInstance call. Selector state is kept in a
+// map separate from serviceMap, so a Refresh never resets it.
+func (cache *ConsulCache) SetSelector(serviceName string, s Selector) {
+	cache.selMu.Lock()
+	defer cache.selMu.Unlock()
+	cache.selectors[serviceName] = s
+}
+
+// selectorFor returns the Selector configured for serviceName, or a shared
+// random selector if none was set.
+func (cache *ConsulCache) selectorFor(serviceName string) Selector {
+	cache.selMu.Lock()
+	defer cache.selMu.Unlock()
+	if s, ok := cache.selectors[serviceName]; ok {
+		return s
+	}
+	return randomSelector{}
+}
+
+// ReleaseInstance tells the Selector configured for serviceName that the
+// caller is done with instance. Selectors that don't track outstanding
+// requests (the default random, round-robin, weighted-random and rendezvous
+// selectors) ignore it.
+func (cache *ConsulCache) ReleaseInstance(serviceName string, instance *api.AgentService) {
+	if instance == nil {
+		return
+	}
+	if releaser, ok := cache.selectorFor(serviceName).(Releaser); ok {
+		releaser.Release(instance.ID)
+	}
+}
+
+// GetServiceInstanceForKey behaves like GetServiceInstance, but routes
+// through the configured Selector's SelectKey when it implements
+// KeyedSelector (e.g. NewRendezvousSelector), so the same key consistently
+// maps to the same instance across calls. Selectors that don't implement
+// KeyedSelector fall back to their plain Select. Unlike GetServiceInstance,
+// it does not trigger a refresh when the cached slice is empty.
+func (cache *ConsulCache) GetServiceInstanceForKey(serviceName, key string) (*api.AgentService, error) {
+	cache.RLock()
+	val, ok := cache.serviceMap[serviceName]
+	cache.RUnlock()
+	if !ok {
+		return nil, errorServiceNotRegistered
+	}
+	if len(val) == 0 {
+		return nil, errorServiceNotAvailable
+	}
+	if keyed, ok := cache.selectorFor(serviceName).(KeyedSelector); ok {
+		return keyed.SelectKey(key, val), nil
+	}
+	return cache.selectorFor(serviceName).Select(val), nil
+}
+
+// randomSelector reproduces the cache's original behaviour: a uniformly
+// random instance on every call.
+type randomSelector struct{}
+
+func (randomSelector) Select(instances []*api.AgentService) *api.AgentService {
+	return instances[rand.Intn(len(instances))]
+}
+
+// NewRandomSelector returns the default Selector: a uniformly random pick on
+// every call.
+func NewRandomSelector() Selector {
+	return randomSelector{}
+}
+
+// roundRobinSelector cycles through instances in order using an atomic
+// counter, so concurrent callers never race on a shared index.
+type roundRobinSelector struct {
+	counter uint64
+}
+
+// NewRoundRobinSelector returns a Selector that cycles through a service's
+// instances in order.
+func NewRoundRobinSelector() Selector {
+	return &roundRobinSelector{}
+}
+
+func (s *roundRobinSelector) Select(instances []*api.AgentService) *api.AgentService {
+	n := atomic.AddUint64(&s.counter, 1)
+	return instances[int(n-1)%len(instances)]
+}
+
+// weightedRandomSelector picks instances with probability proportional to
+// their "weight=<N>" tag or Meta["weight"] (default weight 1 when neither
+// is present or parses to a positive integer). It implements Refreshable:
+// Refresh builds a Vose's-alias-method table from the instance slice the
+// cache just swapped in, so the common case - Select called with that same
+// slice - picks in O(1) instead of rebuilding a prefix-sum table on every
+// call. Select only trusts the alias table when it was built from a slice
+// of the same length as the one it's given; a narrowed view such as
+// GetServiceInstanceFiltered's falls back to a one-off prefix-sum pick
+// instead of risking a mismatched table.
+type weightedRandomSelector struct {
+	mu    sync.Mutex
+	n     int
+	prob  []float64
+	alias []int
+}
+
+// NewWeightedRandomSelector returns a Selector that favors instances
+// advertising a higher weight, via a "weight=<N>" tag or Meta["weight"].
+func NewWeightedRandomSelector() Selector {
+	return &weightedRandomSelector{}
+}
+
+func (sel *weightedRandomSelector) Refresh(instances []*api.AgentService) {
+	n := len(instances)
+	if n == 0 {
+		sel.mu.Lock()
+		sel.n, sel.prob, sel.alias = 0, nil, nil
+		sel.mu.Unlock()
+		return
+	}
+
+	weights := make([]float64, n)
+	total := 0.0
+	for i, instance := range instances {
+		weights[i] = float64(instanceWeight(instance))
+		total += weights[i]
+	}
+	if total == 0 {
+		sel.mu.Lock()
+		sel.n, sel.prob, sel.alias = n, nil, nil
+		sel.mu.Unlock()
+		return
+	}
+
+	prob := make([]float64, n)
+	alias := make([]int, n)
+	scaled := make([]float64, n)
+	var small, large []int
+	for i, w := range weights {
+		scaled[i] = w * float64(n) / total
+		if scaled[i] < 1 {
+			small = append(small, i)
+		} else {
+			large = append(large, i)
+		}
+	}
+
+	for len(small) > 0 && len(large) > 0 {
+		lo := small[len(small)-1]
+		small = small[:len(small)-1]
+		hi := large[len(large)-1]
+		large = large[:len(large)-1]
+
+		prob[lo] = scaled[lo]
+		alias[lo] = hi
+
+		scaled[hi] = scaled[hi] + scaled[lo] - 1
+		if scaled[hi] < 1 {
+			small = append(small, hi)
+		} else {
+			large = append(large, hi)
+		}
+	}
+	for _, i := range large {
+		prob[i] = 1
+	}
+	for _, i := range small {
+		prob[i] = 1
+	}
+
+	sel.mu.Lock()
+	sel.n, sel.prob, sel.alias = n, prob, alias
+	sel.mu.Unlock()
+}
+
+func (sel *weightedRandomSelector) Select(instances []*api.AgentService) *api.AgentService {
+	sel.mu.Lock()
+	n, prob, alias := sel.n, sel.prob, sel.alias
+	sel.mu.Unlock()
+
+	if prob == nil || n != len(instances) {
+		return weightedPrefixSumSelect(instances)
+	}
+
+	i := rand.Intn(n)
+	if rand.Float64() < prob[i] {
+		return instances[i]
+	}
+	return instances[alias[i]]
+}
+
+// weightedPrefixSumSelect picks an instance proportional to instanceWeight
+// by building a one-off prefix-sum table for this call. It's the fallback
+// for when no alias table rebuilt by Refresh applies to the given instances
+// slice (not yet refreshed, all weights zero, or a narrowed view).
+func weightedPrefixSumSelect(instances []*api.AgentService) *api.AgentService {
+	prefix := make([]int, len(instances))
+	total := 0
+	for i, instance := range instances {
+		total += instanceWeight(instance)
+		prefix[i] = total
+	}
+	if total == 0 {
+		return instances[rand.Intn(len(instances))]
+	}
+	target := rand.Intn(total)
+	for i, sum := range prefix {
+		if target < sum {
+			return instances[i]
+		}
+	}
+	return instances[len(instances)-1]
+}
+
+// weightTagPrefix marks a tag as carrying an instance's weight, e.g.
+// "weight=5".
+const weightTagPrefix = "weight="
+
+func instanceWeight(instance *api.AgentService) int {
+	if instance.Meta != nil {
+		if w, ok := instance.Meta["weight"]; ok {
+			if parsed := parsePositiveInt(w); parsed > 0 {
+				return parsed
+			}
+		}
+	}
+	for _, tag := range instance.Tags {
+		if strings.HasPrefix(tag, weightTagPrefix) {
+			if parsed := parsePositiveInt(tag[len(weightTagPrefix):]); parsed > 0 {
+				return parsed
+			}
+		}
+	}
+	return 1
+}
+
+func parsePositiveInt(s string) int {
+	n := 0
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return 0
+		}
+		n = n*10 + int(r-'0')
+	}
+	return n
+}
+
+// leastOutstandingSelector tracks in-flight requests per instance ID and
+// always picks the instance with the fewest outstanding requests. Callers
+// must call ReleaseInstance once they're done with the instance returned by
+// Select, or the counter never goes back down.
+type leastOutstandingSelector struct {
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+// NewLeastOutstandingSelector returns a Selector that routes to whichever
+// instance currently has the fewest requests in flight.
+func NewLeastOutstandingSelector() Selector {
+	return &leastOutstandingSelector{inFlight: make(map[string]int)}
+}
+
+func (s *leastOutstandingSelector) Select(instances []*api.AgentService) *api.AgentService {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var best *api.AgentService
+	bestCount := -1
+	for _, instance := range instances {
+		count := s.inFlight[instance.ID]
+		if bestCount == -1 || count < bestCount {
+			best = instance
+			bestCount = count
+		}
+	}
+	s.inFlight[best.ID]++
+	return best
+}
+
+func (s *leastOutstandingSelector) Release(instanceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight[instanceID] > 0 {
+		s.inFlight[instanceID]--
+	}
+}
+
+// rendezvousSelector implements rendezvous (highest random weight) hashing
+// over instance IDs, so a given key consistently maps to the same instance
+// and membership changes only remap roughly 1/N keys.
+type rendezvousSelector struct{}
+
+// NewRendezvousSelector returns a KeyedSelector that sticks a given key to
+// the same instance across calls using rendezvous hashing, so adding or
+// removing an instance only remaps the keys that hashed closest to it.
+func NewRendezvousSelector() Selector {
+	return rendezvousSelector{}
+}
+
+func (rendezvousSelector) Select(instances []*api.AgentService) *api.AgentService {
+	return instances[rand.Intn(len(instances))]
+}
+
+func (rendezvousSelector) SelectKey(key string, instances []*api.AgentService) *api.AgentService {
+	var best *api.AgentService
+	var bestScore uint64
+	for _, instance := range instances {
+		score := rendezvousScore(key, instance.ID)
+		if best == nil || score > bestScore {
+			best = instance
+			bestScore = score
+		}
+	}
+	return best
+}
+
+func rendezvousScore(key, instanceID string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(instanceID))
+	return h.Sum64()
+}
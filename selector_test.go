@@ -0,0 +1,125 @@
+package servicecache
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestWeightedRandomSelectorHonorsWeightTagAndMeta(t *testing.T) {
+
+	fmt.Println("TestWeightedRandomSelectorHonorsWeightTagAndMeta")
+	heavyByTag := createService("1", "authentication-service", 80, "192.168.2.1", "weight=99")
+	heavyByMeta := createService("2", "authentication-service", 80, "192.168.2.2")
+	heavyByMeta.Meta = map[string]string{"weight": "99"}
+	light := createService("3", "authentication-service", 80, "192.168.2.3")
+	instances := []*api.AgentService{heavyByTag, heavyByMeta, light}
+
+	selector := NewWeightedRandomSelector().(*weightedRandomSelector)
+	selector.Refresh(instances)
+
+	counts := map[string]int{}
+	for i := 0; i < 2000; i++ {
+		counts[selector.Select(instances).ID]++
+	}
+	if counts["3"] >= counts["1"] || counts["3"] >= counts["2"] {
+		t.Error("expected the lightly-weighted instance to be picked far less often, got ", counts)
+	}
+
+	fmt.Println("TestWeightedRandomSelectorHonorsWeightTagAndMeta done")
+}
+
+func TestWeightedRandomSelectorFallsBackWithoutMatchingRefresh(t *testing.T) {
+
+	fmt.Println("TestWeightedRandomSelectorFallsBackWithoutMatchingRefresh")
+	instances := []*api.AgentService{
+		createService("1", "authentication-service", 80, "192.168.2.1"),
+		createService("2", "authentication-service", 80, "192.168.2.2"),
+	}
+
+	selector := NewWeightedRandomSelector().(*weightedRandomSelector)
+	// No Refresh yet, so Select must still pick a valid instance instead of
+	// indexing into an empty alias table.
+	picked := selector.Select(instances)
+	if picked == nil {
+		t.Error("expected Select to return an instance even before Refresh was called")
+	}
+
+	selector.Refresh(instances)
+	// A narrower view (e.g. GetServiceInstanceFiltered's matching slice)
+	// doesn't line up with the alias table built for the full slice, so
+	// Select must fall back instead of risking an out-of-range alias.
+	narrowed := instances[:1]
+	if picked := selector.Select(narrowed); picked.ID != "1" {
+		t.Error("expected the fallback pick to come from the narrowed slice, got ", picked.ID)
+	}
+
+	fmt.Println("TestWeightedRandomSelectorFallsBackWithoutMatchingRefresh done")
+}
+
+func TestRoundRobinSelectorCyclesInstances(t *testing.T) {
+
+	fmt.Println("TestRoundRobinSelectorCyclesInstances")
+	instances := []*api.AgentService{
+		createService("1", "authentication-service", 80, "192.168.2.1"),
+		createService("2", "authentication-service", 80, "192.168.2.2"),
+		createService("3", "authentication-service", 80, "192.168.2.3"),
+	}
+
+	selector := NewRoundRobinSelector()
+	for round := 0; round < 2; round++ {
+		for _, want := range instances {
+			if got := selector.Select(instances); got.ID != want.ID {
+				t.Error("expected ", want.ID, " got ", got.ID)
+			}
+		}
+	}
+
+	fmt.Println("TestRoundRobinSelectorCyclesInstances done")
+}
+
+func TestLeastOutstandingSelectorPrefersFewerInFlight(t *testing.T) {
+
+	fmt.Println("TestLeastOutstandingSelectorPrefersFewerInFlight")
+	busy := createService("1", "authentication-service", 80, "192.168.2.1")
+	idle := createService("2", "authentication-service", 80, "192.168.2.2")
+	instances := []*api.AgentService{busy, idle}
+
+	selector := NewLeastOutstandingSelector()
+	selector.Select(instances) // busy now has 1 in flight
+
+	if got := selector.Select(instances); got.ID != idle.ID {
+		t.Error("expected the idle instance to be picked, got ", got.ID)
+	}
+
+	selector.(Releaser).Release(busy.ID)
+	selector.(Releaser).Release(idle.ID)
+	selector.(Releaser).Release(idle.ID)
+
+	if got := selector.Select(instances); got.ID != busy.ID {
+		t.Error("expected the now-released instance to be picked again, got ", got.ID)
+	}
+
+	fmt.Println("TestLeastOutstandingSelectorPrefersFewerInFlight done")
+}
+
+func TestRendezvousSelectorIsStickyPerKey(t *testing.T) {
+
+	fmt.Println("TestRendezvousSelectorIsStickyPerKey")
+	instances := []*api.AgentService{
+		createService("1", "authentication-service", 80, "192.168.2.1"),
+		createService("2", "authentication-service", 80, "192.168.2.2"),
+		createService("3", "authentication-service", 80, "192.168.2.3"),
+	}
+
+	selector := NewRendezvousSelector().(KeyedSelector)
+	first := selector.SelectKey("user-42", instances)
+	for i := 0; i < 10; i++ {
+		if got := selector.SelectKey("user-42", instances); got.ID != first.ID {
+			t.Error("expected the same key to stick to the same instance, got ", got.ID, " want ", first.ID)
+		}
+	}
+
+	fmt.Println("TestRendezvousSelectorIsStickyPerKey done")
+}
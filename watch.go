@@ -0,0 +1,151 @@
+package servicecache
+
+import (
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// CancelFunc stops a previously established Subscribe and releases its channel.
+type CancelFunc func()
+
+// Subscribe returns a channel that receives the current instance slice for
+// serviceName every time it changes, plus a CancelFunc to stop receiving
+// updates. The channel is closed once CancelFunc is called. Subscribe does
+// not itself start watching the service; the service must already be passed
+// to WatchServices (or Config.Services) so a watcher goroutine is running
+// for it.
+func (cache *ConsulCache) Subscribe(serviceName string) (<-chan []*api.AgentService, CancelFunc) {
+	ch := make(chan []*api.AgentService, 1)
+
+	cache.subMu.Lock()
+	cache.subscribers[serviceName] = append(cache.subscribers[serviceName], ch)
+	cache.subMu.Unlock()
+
+	cancel := func() {
+		cache.subMu.Lock()
+		defer cache.subMu.Unlock()
+		subs := cache.subscribers[serviceName]
+		for i, c := range subs {
+			if c == ch {
+				cache.subscribers[serviceName] = append(subs[:i], subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+	}
+	return ch, cancel
+}
+
+// publish fans the current instance slice for serviceName out to every
+// subscriber. Subscriber channels are buffered with size 1 and hold only the
+// latest value, so a slow subscriber never blocks the watcher goroutine.
+func (cache *ConsulCache) publish(serviceName string, instances []*api.AgentService) {
+	cache.subMu.Lock()
+	defer cache.subMu.Unlock()
+	for _, ch := range cache.subscribers[serviceName] {
+		select {
+		case ch <- instances:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- instances
+		}
+	}
+}
+
+// watchService runs a blocking query loop against Consul's health endpoint
+// for serviceName, blocking on the last known X-Consul-Index until the
+// instance list changes. It replaces the slice in serviceMap atomically and
+// publishes the update to any Subscribe channels. refreshIntervall is used
+// as the blocking query's wait time, so the loop also acts as a max-stale
+// safety net: even without a change, Consul returns at least that often and
+// watchService re-issues the query. The loop exits as soon as the cache's
+// root context is canceled, so Stop() tears every watcher down immediately
+// instead of waiting out an in-flight blocking query.
+//
+// watchService is serviceName's primary update path in steady state (the
+// ticker-driven RefreshCtx is the fallback), so every successful query here
+// - whether or not it actually changed the instance list - records the same
+// Metrics.RefreshOk/lastSuccess bookkeeping RefreshCtx does. Without that,
+// StalenessTolerance would see a service the watcher is keeping perfectly
+// fresh as stale and evict it.
+//
+// watchService joins cache.wg before returning, so Stop() can block until
+// every watcher has actually exited instead of racing the next Start against
+// a goroutine still reading cache.ctx. On a non-context error (e.g. Consul
+// unreachable), it backs off for refreshIntervall before retrying, so a
+// persistently failing query doesn't busy-loop requests as fast as the
+// network round-trip allows.
+func (cache *ConsulCache) watchService(serviceName string) {
+	defer cache.wg.Done()
+	ctx := cache.ctx
+	var waitIndex uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		start := time.Now()
+		instances, lastIndex, err := cache.healthQueryFunc(ctx, serviceName, cache.filterFor(serviceName), waitIndex, cache.refreshIntervall)
+		duration := time.Since(start)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			cache.metrics.RefreshError(serviceName)
+			cache.logger.With("service", serviceName).Errorf("watch failed: %v", err)
+			select {
+			case cache.ErrorChan <- err:
+			default:
+				// Nothing is draining ErrorChan right now (e.g. Start's
+				// retry loop already exited); logging/metrics above is
+				// the record of this error, so don't block the watcher
+				// waiting for a reader that may never come.
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(cache.refreshIntervall):
+				// Back off instead of busy-looping requests at a
+				// persistently unreachable or flapping Consul.
+			}
+			continue
+		}
+
+		cache.Lock()
+		cache.lastSuccess[serviceName] = time.Now()
+		cache.Unlock()
+		cache.metrics.RefreshOk(serviceName, duration, len(instances))
+
+		if lastIndex == waitIndex {
+			// blocking query timed out without a change
+			continue
+		}
+		waitIndex = lastIndex
+
+		cache.Lock()
+		cache.serviceMap[serviceName] = instances
+		cache.serviceVersions[serviceName]++
+		cache.Unlock()
+		cache.refreshSelector(serviceName, instances)
+
+		cache.publish(serviceName, instances)
+	}
+}
+
+// startWatchers launches one watchService goroutine per currently watched
+// service, bound to the cache's current root context, registering each with
+// cache.wg so Stop() can wait for all of them to exit.
+func (cache *ConsulCache) startWatchers() {
+	cache.RLock()
+	defer cache.RUnlock()
+	for serviceName := range cache.serviceMap {
+		cache.wg.Add(1)
+		go cache.watchService(serviceName)
+	}
+}